@@ -0,0 +1,137 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	model "github.com/cloudreve/Cloudreve/v3/models"
+	"github.com/cloudreve/Cloudreve/v3/pkg/filesystem/fsctx"
+	"github.com/cloudreve/Cloudreve/v3/pkg/util"
+)
+
+// fileBlobHashMetadataKey 上传流水线在写入物理文件的同时对内容求出的
+// 哈希（BLAKE3/SHA-256）会以此键写入 Metadata，AddFile 直接复用该值
+// 做去重查找，不需要再读一遍文件
+const fileBlobHashMetadataKey = "content_blob_hash"
+
+// findExistingBlob 在插入新的 model.File 记录前检查 file_blobs 表中是否
+// 已存在相同哈希+大小的物理对象。这一步只做查找和（必要时的）blob 记录
+// 创建，不会修改 newFile 的任何状态——是否真正把 newFile 指向该 blob，
+// 要等 newFile.Create() 确认落库成功后由 finalizeDedup 决定，避免在记录
+// 尚未创建前就提前增加引用计数或删除本次上传产生的物理文件。
+//
+// 返回的 isNew 标记这个 blob 是不是本次调用刚创建的：如果是，newFile 本身
+// 就是该 blob 唯一的物理持有者，finalizeDedup 需要走不同的分支——只把
+// newFile 登记为持有者（refcount 已经由 CreateFileBlob 初始化为 1），既不
+// 能再次增加引用计数，也不能删除 newFile 自己的物理文件
+func (fs *FileSystem) findExistingBlob(uploadInfo fsctx.UploadTaskInfo) (blob *model.FileBlob, isNew bool) {
+	hash, ok := uploadInfo.Metadata[fileBlobHashMetadataKey]
+	if !ok || hash == "" {
+		// 上传流水线没有计算出哈希（例如策略未启用流式哈希），跳过去重
+		return nil, false
+	}
+
+	existing, err := model.GetFileBlobByHash(hash, uploadInfo.Size)
+	if err != nil {
+		created, createErr := model.CreateFileBlob(hash, uploadInfo.Size, uploadInfo.SavePath, fs.Policy.ID)
+		if createErr != nil {
+			util.Log().Warning("Failed to create file blob record for %q: %s", uploadInfo.SavePath, createErr)
+			return nil, false
+		}
+		// 这是第一次看到这份内容，created 这条 blob 记录的物理对象就是
+		// newFile 本次上传产生的文件本身，必须把 newFile 登记为它的持有者，
+		// 否则之后删除 newFile 时 BlobID 为空，会绕过引用计数直接物理删除，
+		// 导致后续所有 dedup 命中该 blob 的文件都指向一个已被删除的对象
+		return created, true
+	}
+
+	return existing, false
+}
+
+// finalizeDedup 在 newFile.Create() 成功后才提交去重。分两种情况：
+//
+//   - blob 是本次 findExistingBlob 新建的（isNew）：newFile 就是这个 blob
+//     唯一的物理持有者，只需要把 newFile 登记到该 blob 上，不增加引用计数
+//     （CreateFileBlob 已将其初始化为 1），也不删除物理文件（它正是该 blob
+//     的物理对象）
+//   - blob 是已有记录（命中去重）：先增加引用计数，只有增加成功才把
+//     newFile 改写为指向该共享物理对象并删除本次上传产生的重复文件。如果
+//     引用计数增加失败，说明无法安全地让两条 File 记录共享同一物理对象——
+//     否则任一记录先被删除都会把计数带到 0 并误删另一条记录仍在引用的
+//     内容——此时放弃去重，newFile 保留它自己上传产生的独立物理文件
+func (fs *FileSystem) finalizeDedup(ctx context.Context, newFile *model.File, existing *model.FileBlob, isNew bool, uploadInfo fsctx.UploadTaskInfo) {
+	if isNew {
+		if err := newFile.AliasToBlob(existing.SourceName, existing.ID); err != nil {
+			util.Log().Warning("Failed to register file %d as holder of newly created blob %d: %s", newFile.ID, existing.ID, err)
+		}
+		return
+	}
+
+	if err := existing.IncrementRefCount(); err != nil {
+		util.Log().Warning("Failed to increment refcount for blob %d, keeping independent copy for file %d: %s", existing.ID, newFile.ID, err)
+		return
+	}
+
+	if err := newFile.AliasToBlob(existing.SourceName, existing.ID); err != nil {
+		util.Log().Warning("Failed to alias file %d to blob %d, keeping independent copy: %s", newFile.ID, existing.ID, err)
+		if _, decErr := model.DecrementFileBlobRefCount(existing.ID); decErr != nil {
+			util.Log().Warning("Failed to roll back refcount for blob %d: %s", existing.ID, decErr)
+		}
+		return
+	}
+
+	if failed, delErr := fs.Handler.Delete(ctx, []string{uploadInfo.SavePath}); delErr != nil || len(failed) > 0 {
+		util.Log().Warning("Failed to remove duplicate physical object %q after dedup hit: %s", uploadInfo.SavePath, delErr)
+	}
+}
+
+// blobVerifySampleSize 每次后台抽样校验随机抽取的 blob 数量
+const blobVerifySampleSize = 100
+
+// VerifyBlobIntegrity 随机抽取一部分 file_blobs 记录，重新计算物理内容的
+// 哈希并与数据库中记录的值比对，用来发现存储后端数据损坏、被意外覆盖等
+// 导致的内容漂移。建议由后台定时任务周期性调用，而不是在请求路径上执行
+func (fs *FileSystem) VerifyBlobIntegrity(ctx context.Context) error {
+	blobs, err := model.GetRandomFileBlobs(blobVerifySampleSize)
+	if err != nil {
+		return fmt.Errorf("failed to sample file blobs: %w", err)
+	}
+
+	for _, blob := range blobs {
+		fs.Policy = blob.GetPolicy()
+		if err := fs.DispatchHandler(); err != nil {
+			util.Log().Warning("Failed to dispatch handler for blob %d during verification: %s", blob.ID, err)
+			continue
+		}
+
+		rs, err := fs.Handler.Get(ctx, blob.SourceName)
+		if err != nil {
+			util.Log().Warning("Blob %d physical object %q appears to be missing: %s", blob.ID, blob.SourceName, err)
+			continue
+		}
+
+		actualHash, err := hashBlobContent(rs)
+		rs.Close()
+		if err != nil {
+			util.Log().Warning("Failed to re-hash blob %d: %s", blob.ID, err)
+			continue
+		}
+
+		if actualHash != blob.Hash {
+			util.Log().Warning("Detected content drift for blob %d: expected hash %s, got %s", blob.ID, blob.Hash, actualHash)
+		}
+	}
+
+	return nil
+}
+
+func hashBlobContent(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
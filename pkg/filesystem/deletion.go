@@ -0,0 +1,459 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	model "github.com/cloudreve/Cloudreve/v3/models"
+	"github.com/cloudreve/Cloudreve/v3/pkg/cache"
+	"github.com/cloudreve/Cloudreve/v3/pkg/serializer"
+	"github.com/cloudreve/Cloudreve/v3/pkg/util"
+)
+
+// dup 返回 fs 的浅拷贝，用于需要在独立 goroutine 中安全切换
+// Policy/Handler 而不影响原有 FileSystem 实例的场景
+func (fs *FileSystem) dup() *FileSystem {
+	clone := *fs
+	return &clone
+}
+
+// policyDeleteBatchSize 不同存储策略单次删除请求所能携带的最大文件数，
+// 取自各家对象存储 API 的硬性限制
+var policyDeleteBatchSize = map[string]int{
+	"s3":    1000,
+	"oss":   1000,
+	"cos":   1000,
+	"upyun": 100,
+	"qiniu": 100,
+}
+
+// defaultDeleteBatchSize 未在 policyDeleteBatchSize 中列出的策略使用的默认批大小
+const defaultDeleteBatchSize = 100
+
+// deleteRetryAttempts 单个删除批次遇到错误时的最大尝试次数（含首次请求，即最多重试 2 次）
+const deleteRetryAttempts = 3
+
+// deleteRetryBaseDelay 指数退避的初始等待时间
+const deleteRetryBaseDelay = 500 * time.Millisecond
+
+// DeletionJobStatus 批量删除任务的状态
+type DeletionJobStatus int
+
+const (
+	// DeletionJobRunning 任务正在执行
+	DeletionJobRunning DeletionJobStatus = iota
+	// DeletionJobCompleted 任务已完成，可能包含部分失败的文件
+	DeletionJobCompleted
+)
+
+// DeletionJob 记录一次分组批量删除的进度，供前端轮询展示
+type DeletionJob struct {
+	mu sync.Mutex
+
+	// ID 任务 ID，由 registerDeletionJob 分配，用于 GetDeletionJob 查询
+	ID string
+	// TotalFiles 本次任务需要删除的文件总数
+	TotalFiles int
+	// Deleted 已成功删除的文件数
+	Deleted int
+	// Failed 每个策略下删除失败的物理路径
+	Failed map[uint][]string
+	// Status 任务当前状态
+	Status DeletionJobStatus
+}
+
+func newDeletionJob(total int) *DeletionJob {
+	return &DeletionJob{
+		TotalFiles: total,
+		Failed:     make(map[uint][]string),
+		Status:     DeletionJobRunning,
+	}
+}
+
+// deletionJobRegistry 保存进程内仍可查询的分组删除任务，供调用方（如后台
+// 管理界面）在任务运行期间轮询进度。这是纯内存态的索引——真正保证“进程
+// 崩溃后能继续完成未处理完的删除”的是 pending_deletions 表，注册表本身
+// 随进程重启清空，重启后的续传由 ResumePendingDeletions 负责，与轮询索引
+// 无关
+var (
+	deletionJobRegistry   = make(map[string]*DeletionJob)
+	deletionJobRegistryMu sync.RWMutex
+)
+
+// registerDeletionJob 为 job 分配一个不可预测的 ID 并加入注册表
+func registerDeletionJob(job *DeletionJob) string {
+	id, err := newDeletionJobID()
+	if err != nil {
+		// 随机数生成失败的概率极低，退化为基于时间的 ID：任务本身仍会
+		// 正常执行，只是 ID 可预测，不影响删除的正确性
+		id = fmt.Sprintf("fallback-%d", time.Now().UnixNano())
+	}
+
+	job.ID = id
+
+	deletionJobRegistryMu.Lock()
+	deletionJobRegistry[id] = job
+	deletionJobRegistryMu.Unlock()
+
+	return id
+}
+
+// newDeletionJobID 生成一个不可预测的任务 ID
+func newDeletionJobID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// GetDeletionJob 供调用方（如管理后台批量删除页面）轮询一次分组删除任务
+// 当前的进度，在任务完成后仍可查询一次最终结果
+func GetDeletionJob(id string) (DeletionJob, bool) {
+	deletionJobRegistryMu.RLock()
+	job, ok := deletionJobRegistry[id]
+	deletionJobRegistryMu.RUnlock()
+	if !ok {
+		return DeletionJob{}, false
+	}
+
+	return job.Snapshot(), true
+}
+
+func (j *DeletionJob) addDeleted(n int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Deleted += n
+}
+
+func (j *DeletionJob) addFailed(policyID uint, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Failed[policyID] = append(j.Failed[policyID], paths...)
+}
+
+// Snapshot 返回当前进度的一份拷贝，避免调用方持有内部锁
+func (j *DeletionJob) Snapshot() DeletionJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	failed := make(map[uint][]string, len(j.Failed))
+	for k, v := range j.Failed {
+		failed[k] = append([]string(nil), v...)
+	}
+	return DeletionJob{
+		ID:         j.ID,
+		TotalFiles: j.TotalFiles,
+		Deleted:    j.Deleted,
+		Failed:     failed,
+		Status:     j.Status,
+	}
+}
+
+// deleteBatchSizeForPolicy 返回给定存储策略单次删除请求的最大文件数
+func deleteBatchSizeForPolicy(policyType string) int {
+	if size, ok := policyDeleteBatchSize[policyType]; ok {
+		return size
+	}
+	return defaultDeleteBatchSize
+}
+
+// deleteWorkerNum 返回每个存储策略对应的并发 worker 数量，可由管理员在后台配置
+func deleteWorkerNum() int {
+	return model.GetIntSetting("delete_worker_num", 4)
+}
+
+// deleteGroupedFile 对分组好的文件执行并发删除操作，阻塞直到全部完成，
+// 返回每个分组失败的文件列表。调用量较小、不需要前端轮询进度的场景
+// （例如删除单个文件、几十个文件的批量操作）直接用这个同步接口即可；
+// 需要轮询进度的大批量删除见 StartDeletionJobAsync。
+//
+// 删除前会先将所有待删除的物理路径写入 pending_deletions 表，每个策略内部按照
+// 该策略支持的最大批量大小切分为若干批次，由一个有界 worker 池并发处理；
+// 单个批次遇到网络抖动等临时性错误时按指数退避重试。每个策略分组在表中
+// 只有一条记录，该分组的全部批次处理完成（无论成功与否）后才整体移除，
+// 因此进程崩溃后重启可以根据表中剩余记录重新下发这些分组的删除（其中已经
+// 删除过的路径也会再次下发），见 ResumePendingDeletions。
+func (fs *FileSystem) deleteGroupedFile(ctx context.Context, files map[uint][]*model.File) map[uint][]string {
+	job := newDeletionJobFor(files)
+	registerDeletionJob(job)
+	fs.runDeletionJob(ctx, files, job)
+	return job.Snapshot().Failed
+}
+
+// StartDeletionJobAsync 启动一次分组删除并立即返回任务 ID，不等待删除完成。
+// 用于后台管理界面一次性删除成千上万个文件的场景：调用方可以立刻返回任务
+// ID 给前端，再通过 GetDeletionJob 轮询进度，而不必让 HTTP 请求阻塞到整个
+// 删除流程结束
+func (fs *FileSystem) StartDeletionJobAsync(ctx context.Context, files map[uint][]*model.File) string {
+	job := newDeletionJobFor(files)
+	id := registerDeletionJob(job)
+
+	go fs.runDeletionJob(ctx, files, job)
+
+	return id
+}
+
+// newDeletionJobFor 按分组文件数统计出一个待执行任务的初始状态
+func newDeletionJobFor(files map[uint][]*model.File) *DeletionJob {
+	total := 0
+	for _, group := range files {
+		total += len(group)
+	}
+	return newDeletionJob(total)
+}
+
+// runDeletionJob 并发处理每个策略分组的删除，并在全部完成后将 job 标记为
+// DeletionJobCompleted。deleteGroupedFile 和 StartDeletionJobAsync 的区别
+// 只在于是否阻塞等待这个函数返回
+func (fs *FileSystem) runDeletionJob(ctx context.Context, files map[uint][]*model.File, job *DeletionJob) {
+	var wg sync.WaitGroup
+	for policyID, toBeDeletedFiles := range files {
+		wg.Add(1)
+		go func(policyID uint, toBeDeletedFiles []*model.File) {
+			defer wg.Done()
+			fs.deletePolicyGroup(ctx, policyID, toBeDeletedFiles, job)
+		}(policyID, toBeDeletedFiles)
+	}
+	wg.Wait()
+
+	job.mu.Lock()
+	job.Status = DeletionJobCompleted
+	job.mu.Unlock()
+}
+
+// ResumePendingDeletions 读取 pending_deletions 表中遗留的记录——上一次
+// 进程崩溃或被强制终止时，已经落库但尚未确认删除完成的物理路径批次——按
+// 策略重新下发物理删除。应当在服务启动、开始处理任何请求之前调用一次；
+// 此后每批成功处理（无论是否有文件删除失败）的记录都会被照常清除，所以
+// 正常关闭不会留下需要续传的记录
+func ResumePendingDeletions(ctx context.Context) error {
+	pendings, err := model.ListPendingDeletions()
+	if err != nil {
+		return fmt.Errorf("failed to list leftover pending deletions: %w", err)
+	}
+
+	if len(pendings) == 0 {
+		return nil
+	}
+
+	util.Log().Info("Resuming %d leftover pending deletion batch(es) left behind by a previous run", len(pendings))
+
+	bySrcs := make(map[uint][]string)
+	byRecords := make(map[uint][]*model.PendingDeletion)
+	for _, p := range pendings {
+		bySrcs[p.PolicyID] = append(bySrcs[p.PolicyID], p.SourceNames...)
+		byRecords[p.PolicyID] = append(byRecords[p.PolicyID], p)
+	}
+
+	for policyID, srcs := range bySrcs {
+		policy, err := model.GetPolicyByID(policyID)
+		if err != nil {
+			util.Log().Warning("Failed to resume pending deletion for policy %d, policy no longer exists: %s", policyID, err)
+			continue
+		}
+
+		handlerFs := &FileSystem{Policy: policy}
+		if err := handlerFs.DispatchHandler(); err != nil {
+			util.Log().Warning("Failed to dispatch handler to resume pending deletion for policy %d: %s", policyID, err)
+			continue
+		}
+
+		batches := chunkStrings(srcs, deleteBatchSizeForPolicy(policy.Type))
+		var failedAll []string
+		for _, batch := range batches {
+			failedAll = append(failedAll, handlerFs.deleteBatchWithRetry(ctx, handlerFs, batch)...)
+		}
+
+		if len(failedAll) > 0 {
+			util.Log().Warning("%d physical object(s) under policy %d could not be deleted while resuming pending deletions", len(failedAll), policyID)
+		}
+
+		for _, record := range byRecords[policyID] {
+			if err := model.DeletePendingDeletions(record); err != nil {
+				util.Log().Warning("Failed to clear resumed pending deletion record for policy %d: %s", policyID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// deletePolicyGroup 负责单个存储策略下的批量删除，使用有界 worker 池并发
+// 处理各批次
+func (fs *FileSystem) deletePolicyGroup(ctx context.Context, policyID uint, toBeDeletedFiles []*model.File, job *DeletionJob) {
+	if len(toBeDeletedFiles) == 0 {
+		return
+	}
+
+	// 先确认这个策略的 handler 能正常调度，再决定是否触碰任何 blob 的引用
+	// 计数。引用计数的递减必须和“物理删除确实会被尝试”绑在一起——如果
+	// handler 调度失败，整组文件的物理删除根本不会发生，此时如果已经
+	// 提前把引用计数减到了 0，会让仍然指向这份物理内容的 blob 被判定为
+	// 无人引用，而它实际从未被删除，造成永久性的孤儿对象且无法被
+	// ResumePendingDeletions 之类的机制感知和修复
+	policy := toBeDeletedFiles[0].GetPolicy()
+	handlerFs := fs.dup()
+	handlerFs.Policy = policy
+	if err := handlerFs.DispatchHandler(); err != nil {
+		sourceNamesAll := make([]string, 0, len(toBeDeletedFiles))
+		for _, file := range toBeDeletedFiles {
+			sourceNamesAll = append(sourceNamesAll, file.SourceName)
+		}
+		job.addFailed(policyID, sourceNamesAll)
+		return
+	}
+
+	sourceNamesAll := make([]string, 0, len(toBeDeletedFiles))
+	uploadSessions := make([]*serializer.UploadSession, 0, len(toBeDeletedFiles))
+	thumbs := make([]string, 0)
+
+	for _, file := range toBeDeletedFiles {
+		// 文件记录本身即将被删除，索引需要同步清理，与是否还需要物理删除
+		// 底层 blob 无关
+		fs.removeFileFromIndex(ctx, file.ID)
+
+		if file.BlobID != nil {
+			remaining, err := model.DecrementFileBlobRefCount(*file.BlobID)
+			if err != nil {
+				// 引用计数状态未知时按“仍被引用”处理，跳过物理删除而不是
+				// 冒险删掉其他文件可能还在依赖的共享内容——宁可留下应该被
+				// 回收的 blob 等下次校验/重试处理，也不能误删
+				util.Log().Warning("Failed to decrement refcount for blob %d, skipping physical delete to be safe: %s", *file.BlobID, err)
+				continue
+			}
+			if remaining > 0 {
+				// 仍有其他文件引用同一份物理内容，跳过本文件的物理删除
+				continue
+			}
+		}
+
+		sourceNamesAll = append(sourceNamesAll, file.SourceName)
+
+		if file.UploadSessionID != nil {
+			if session, ok := cache.Get(UploadSessionCachePrefix + *file.UploadSessionID); ok {
+				uploadSession := session.(serializer.UploadSession)
+				uploadSessions = append(uploadSessions, &uploadSession)
+			}
+		}
+
+		if model.IsTrueVal(file.MetadataSerialized[model.ThumbSidecarMetadataKey]) {
+			thumbs = append(thumbs, file.ThumbFile())
+		}
+	}
+
+	// 取消上传会话，失败不阻塞后续删除
+	for _, upSession := range uploadSessions {
+		if err := handlerFs.Handler.CancelToken(ctx, upSession); err != nil {
+			util.Log().Warning("Failed to cancel upload session for %q: %s", upSession.Name, err)
+		}
+		cache.Deletes([]string{upSession.Key}, UploadSessionCachePrefix)
+	}
+
+	toBeDeletedSrcs := append(sourceNamesAll, thumbs...)
+
+	// 落库，记录本批次待删除的物理路径，用于崩溃恢复
+	pending, err := model.CreatePendingDeletions(policyID, toBeDeletedSrcs)
+	if err != nil {
+		util.Log().Warning("Failed to persist pending deletion for policy %d: %s", policyID, err)
+	}
+
+	batchSize := deleteBatchSizeForPolicy(policy.Type)
+	batches := chunkStrings(toBeDeletedSrcs, batchSize)
+
+	workerNum := deleteWorkerNum()
+	if workerNum > len(batches) {
+		workerNum = len(batches)
+	}
+	if workerNum < 1 {
+		workerNum = 1
+	}
+
+	batchCh := make(chan []string, len(batches))
+	for _, b := range batches {
+		batchCh <- b
+	}
+	close(batchCh)
+
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	var failedAll []string
+
+	for i := 0; i < workerNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batchCh {
+				failedInBatch := fs.deleteBatchWithRetry(ctx, handlerFs, batch)
+
+				failedMu.Lock()
+				failedAll = append(failedAll, failedInBatch...)
+				failedMu.Unlock()
+
+				job.addDeleted(len(batch) - len(failedInBatch))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if pending != nil {
+		if err := model.DeletePendingDeletions(pending); err != nil {
+			util.Log().Warning("Failed to clear pending deletion records for policy %d: %s", policyID, err)
+		}
+	}
+
+	// 缩略图的删除失败无需上报给调用方
+	job.addFailed(policyID, util.SliceDifference(failedAll, thumbs))
+}
+
+// deleteBatchWithRetry 对单个批次执行删除，失败时按指数退避重试
+func (fs *FileSystem) deleteBatchWithRetry(ctx context.Context, handlerFs *FileSystem, batch []string) []string {
+	var failed []string
+	var err error
+
+	delay := deleteRetryBaseDelay
+	for attempt := 0; attempt < deleteRetryAttempts; attempt++ {
+		failed, err = handlerFs.Handler.Delete(ctx, batch)
+		if err == nil {
+			return failed
+		}
+
+		if attempt == deleteRetryAttempts-1 {
+			break
+		}
+
+		util.Log().Debug("Batch delete attempt %d failed, retrying in %s: %s", attempt+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	if err != nil {
+		util.Log().Warning("Batch delete still failing after %d attempts: %s", deleteRetryAttempts, err)
+		return batch
+	}
+
+	return failed
+}
+
+// chunkStrings 将 src 按 size 切分为若干批次
+func chunkStrings(src []string, size int) [][]string {
+	if size <= 0 {
+		size = defaultDeleteBatchSize
+	}
+
+	chunks := make([][]string, 0, (len(src)+size-1)/size)
+	for size < len(src) {
+		src, chunks = src[size:], append(chunks, src[0:size:size])
+	}
+	if len(src) > 0 {
+		chunks = append(chunks, src)
+	}
+
+	return chunks
+}
@@ -2,17 +2,13 @@ package filesystem
 
 import (
 	"context"
-	"fmt"
-	"io"
 
 	model "github.com/cloudreve/Cloudreve/v3/models"
-	"github.com/cloudreve/Cloudreve/v3/pkg/cache"
 	"github.com/cloudreve/Cloudreve/v3/pkg/conf"
 	"github.com/cloudreve/Cloudreve/v3/pkg/filesystem/fsctx"
 	"github.com/cloudreve/Cloudreve/v3/pkg/filesystem/response"
 	"github.com/cloudreve/Cloudreve/v3/pkg/serializer"
 	"github.com/cloudreve/Cloudreve/v3/pkg/util"
-	"github.com/juju/ratelimit"
 )
 
 /* ============
@@ -20,30 +16,6 @@ import (
    ============
 */
 
-// 限速后的ReaderSeeker
-type lrs struct {
-	response.RSCloser
-	r io.Reader
-}
-
-func (r lrs) Read(p []byte) (int, error) {
-	return r.r.Read(p)
-}
-
-// withSpeedLimit 给原有的ReadSeeker加上限速
-func (fs *FileSystem) withSpeedLimit(rs response.RSCloser) response.RSCloser {
-	// 如果用户组有速度限制，就返回限制流速的ReaderSeeker
-	if fs.User.Group.SpeedLimit != 0 {
-		speed := fs.User.Group.SpeedLimit
-		bucket := ratelimit.NewBucketWithRate(float64(speed), int64(speed))
-		lrs := lrs{rs, ratelimit.Reader(rs, bucket)}
-		return lrs
-	}
-	// 否则返回原始流
-	return rs
-
-}
-
 // AddFile 新增文件记录
 func (fs *FileSystem) AddFile(ctx context.Context, parent *model.Folder, file fsctx.FileHeader) (*model.File, error) {
 	// 添加文件记录前的钩子
@@ -64,6 +36,15 @@ func (fs *FileSystem) AddFile(ctx context.Context, parent *model.Folder, file fs
 		UploadSessionID:    uploadInfo.UploadSessionID,
 	}
 
+	// 策略开启去重时，先查找是否已有相同内容的物理对象，但在 newFile 确认
+	// 创建成功前不对 newFile 或 file_blobs 做任何修改，避免记录创建失败时
+	// 留下指向共享 blob 却无人持有的悬空引用计数
+	var dedupBlob *model.FileBlob
+	var dedupBlobIsNew bool
+	if fs.Policy.IsDedupEnabled() {
+		dedupBlob, dedupBlobIsNew = fs.findExistingBlob(uploadInfo)
+	}
+
 	err = newFile.Create()
 
 	if err != nil {
@@ -73,12 +54,25 @@ func (fs *FileSystem) AddFile(ctx context.Context, parent *model.Folder, file fs
 		return nil, ErrFileExisted.WithError(err)
 	}
 
+	if dedupBlob != nil {
+		fs.finalizeDedup(ctx, &newFile, dedupBlob, dedupBlobIsNew, uploadInfo)
+	}
+
 	fs.User.Storage += newFile.Size
+	fs.indexFile(ctx, &newFile)
+
 	return &newFile, nil
 }
 
 // GetPhysicalFileContent 根据文件物理路径获取文件流
 func (fs *FileSystem) GetPhysicalFileContent(ctx context.Context, path string) (response.RSCloser, error) {
+	// 如果本次请求是经由签名链接到达的（典型场景：从机模式下接收主机转发的
+	// 签名请求），在真正读取物理内容前回表校验该签名的 scope 是否仍然允许
+	// 访问
+	if err := enforceSignedURLScope(ctx); err != nil {
+		return nil, err
+	}
+
 	// 重设上传策略
 	fs.Policy = &model.Policy{Type: "local"}
 	_ = fs.DispatchHandler()
@@ -109,6 +103,21 @@ func (fs *FileSystem) Preview(ctx context.Context, id uint, isText bool) (*respo
 		return nil, ErrFileSizeTooBig
 	}
 
+	// 优先尝试走转码预览流水线（视频/图片缩略图、文档转 PDF、代码文件的
+	// 只读语法高亮等），该流水线内建按内容哈希+参数的缓存，命中时不会重复
+	// 转码。isText 预览不会进入这条流水线——它需要原始字节供前端编辑器
+	// 使用，见 resolvePreviewParams 的说明
+	if params, ok := fs.resolvePreviewParams(isText); ok {
+		resp, err := fs.transcodedPreview(ctx, &fs.FileTarget[0], params)
+		if err == nil {
+			return resp, nil
+		}
+		if err != ErrNotSupportedType {
+			return nil, err
+		}
+		// 没有启用匹配的转码后端，回退到原有的直出/重定向逻辑
+	}
+
 	// 是否直接返回文件内容
 	if isText || fs.Policy.IsDirectlyPreview() {
 		resp, err := fs.GetDownloadContent(ctx, id)
@@ -156,6 +165,12 @@ func (fs *FileSystem) GetContent(ctx context.Context, id uint) (response.RSClose
 	}
 	ctx = context.WithValue(ctx, fsctx.FileModelCtx, fs.FileTarget[0])
 
+	// 如果本次请求是经由签名链接到达的，在真正读取物理内容前回表校验
+	// 该签名的 scope 是否仍然允许访问
+	if err := enforceSignedURLScope(ctx); err != nil {
+		return nil, err
+	}
+
 	// 获取文件流
 	rs, err := fs.Handler.Get(ctx, fs.FileTarget[0].SourceName)
 	if err != nil {
@@ -165,63 +180,6 @@ func (fs *FileSystem) GetContent(ctx context.Context, id uint) (response.RSClose
 	return rs, nil
 }
 
-// deleteGroupedFile 对分组好的文件执行删除操作，
-// 返回每个分组失败的文件列表
-func (fs *FileSystem) deleteGroupedFile(ctx context.Context, files map[uint][]*model.File) map[uint][]string {
-	// 失败的文件列表
-	// TODO 并行删除
-	failed := make(map[uint][]string, len(files))
-	thumbs := make([]string, 0)
-
-	for policyID, toBeDeletedFiles := range files {
-		// 列举出需要物理删除的文件的物理路径
-		sourceNamesAll := make([]string, 0, len(toBeDeletedFiles))
-		uploadSessions := make([]*serializer.UploadSession, 0, len(toBeDeletedFiles))
-
-		for i := 0; i < len(toBeDeletedFiles); i++ {
-			sourceNamesAll = append(sourceNamesAll, toBeDeletedFiles[i].SourceName)
-
-			if toBeDeletedFiles[i].UploadSessionID != nil {
-				if session, ok := cache.Get(UploadSessionCachePrefix + *toBeDeletedFiles[i].UploadSessionID); ok {
-					uploadSession := session.(serializer.UploadSession)
-					uploadSessions = append(uploadSessions, &uploadSession)
-				}
-			}
-
-			// Check if sidecar thumb file exist
-			if model.IsTrueVal(toBeDeletedFiles[i].MetadataSerialized[model.ThumbSidecarMetadataKey]) {
-				thumbs = append(thumbs, toBeDeletedFiles[i].ThumbFile())
-			}
-		}
-
-		// 切换上传策略
-		fs.Policy = toBeDeletedFiles[0].GetPolicy()
-		err := fs.DispatchHandler()
-		if err != nil {
-			failed[policyID] = sourceNamesAll
-			continue
-		}
-
-		// 取消上传会话
-		for _, upSession := range uploadSessions {
-			if err := fs.Handler.CancelToken(ctx, upSession); err != nil {
-				util.Log().Warning("Failed to cancel upload session for %q: %s", upSession.Name, err)
-			}
-
-			cache.Deletes([]string{upSession.Key}, UploadSessionCachePrefix)
-		}
-
-		// 执行删除
-		toBeDeletedSrcs := append(sourceNamesAll, thumbs...)
-		failedFile, _ := fs.Handler.Delete(ctx, toBeDeletedSrcs)
-
-		// Exclude failed results related to thumb file
-		failed[policyID] = util.SliceDifference(failedFile, thumbs)
-	}
-
-	return failed
-}
-
 // GroupFileByPolicy 将目标文件按照存储策略分组
 func (fs *FileSystem) GroupFileByPolicy(ctx context.Context, files []model.File) map[uint][]*model.File {
 	var policyGroup = make(map[uint][]*model.File)
@@ -302,34 +260,6 @@ func (fs *FileSystem) GetSource(ctx context.Context, fileID uint) (string, error
 	return source, nil
 }
 
-// SignURL 签名文件原始 URL
-func (fs *FileSystem) SignURL(ctx context.Context, file *model.File, ttl int64, isDownload bool) (string, error) {
-	fs.FileTarget = []model.File{*file}
-	ctx = context.WithValue(ctx, fsctx.FileModelCtx, *file)
-
-	err := fs.resetPolicyToFirstFile(ctx)
-	if err != nil {
-		return "", err
-	}
-
-	// 签名最终URL
-	// 生成外链地址
-	
-	source, err := fs.Handler.Source(ctx, fs.FileTarget[0].SourceName, ttl, isDownload, fs.User.Group.SpeedLimit)
-	if err != nil {
-
-		// MODIFY START
-
-		util.Log().Error("Failed to get source link: %w", err)
-
-		// MODIFY END
-
-		return "", serializer.NewError(serializer.CodeNotSet, "Failed to get source link", err)
-	}
-
-	return source, nil
-}
-
 // ResetFileIfNotExist 重设当前目标文件为 path，如果当前目标为空
 func (fs *FileSystem) ResetFileIfNotExist(ctx context.Context, path string) error {
 	// 找到文件
@@ -385,25 +315,3 @@ func (fs *FileSystem) resetPolicyToFirstFile(ctx context.Context) error {
 	}
 	return nil
 }
-
-// Search 搜索文件
-func (fs *FileSystem) Search(ctx context.Context, keywords ...interface{}) ([]serializer.Object, error) {
-	parents := make([]uint, 0)
-
-	// 如果限定了根目录，则只在这个根目录下搜索。
-	if fs.Root != nil {
-		allFolders, err := model.GetRecursiveChildFolder([]uint{fs.Root.ID}, fs.User.ID, true)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list all folders: %w", err)
-		}
-
-		for _, folder := range allFolders {
-			parents = append(parents, folder.ID)
-		}
-	}
-
-	files, _ := model.GetFilesByKeywords(fs.User.ID, parents, keywords...)
-	fs.SetTargetFile(&files)
-
-	return fs.listObjects(ctx, "/", files, nil, nil), nil
-}
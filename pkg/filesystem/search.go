@@ -0,0 +1,314 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	model "github.com/cloudreve/Cloudreve/v3/models"
+	"github.com/cloudreve/Cloudreve/v3/pkg/serializer"
+	"github.com/cloudreve/Cloudreve/v3/pkg/util"
+)
+
+// SearchDocument 是写入搜索索引的最小单元，字段全部来自 model.File 本身，
+// 以及已经解析好存入 MetadataSerialized 的 EXIF/ID3 等元数据。MimeType 由
+// 文件扩展名推导，供 `mime:` 结构化查询使用
+type SearchDocument struct {
+	FileID    uint
+	OwnerID   uint
+	FolderID  uint
+	Name      string
+	Metadata  map[string]string
+	Size      uint64
+	MimeType  string
+	UpdatedAt time.Time
+}
+
+// SearchQuery 是 Search 接受的结构化查询。未能解析为 field:value 的关键字
+// 归入 Keywords 按全文检索处理
+type SearchQuery struct {
+	Keywords []string
+	Fields   map[string]string
+	MinSize  *uint64
+	MaxSize  *uint64
+	After    *time.Time
+	Before   *time.Time
+	MimeType string
+	InFolder string
+}
+
+// SearchIndexer 是可插拔的搜索后端，Index/Delete 由文件生命周期各个
+// 操作点调用以保持索引与数据库同步，Search 负责执行结构化查询
+type SearchIndexer interface {
+	// Name 用于日志与管理端展示
+	Name() string
+	Index(ctx context.Context, doc SearchDocument) error
+	Delete(ctx context.Context, fileID uint) error
+	// Search 返回匹配的文件 ID 列表，scope 为限定搜索的目录 ID（fs.Root 生效
+	// 或使用了 in: 关键字时）
+	Search(ctx context.Context, ownerID uint, scope []uint, query SearchQuery) ([]uint, error)
+}
+
+var (
+	activeIndexer   SearchIndexer
+	activeIndexerMu sync.RWMutex
+)
+
+// SetSearchIndexer 切换当前生效的搜索后端，由启动流程根据
+// `search_indexer` 管理设置（bleve / meilisearch / elasticsearch）调用
+func SetSearchIndexer(indexer SearchIndexer) {
+	activeIndexerMu.Lock()
+	defer activeIndexerMu.Unlock()
+	activeIndexer = indexer
+}
+
+func currentIndexer() SearchIndexer {
+	activeIndexerMu.RLock()
+	defer activeIndexerMu.RUnlock()
+	return activeIndexer
+}
+
+func init() {
+	SetSearchIndexer(newBleveIndexer())
+}
+
+// indexFile 将文件写入当前生效的搜索后端，索引失败不影响主流程，只记录日志
+func (fs *FileSystem) indexFile(ctx context.Context, file *model.File) {
+	indexer := currentIndexer()
+	if indexer == nil {
+		return
+	}
+
+	doc := SearchDocument{
+		FileID:    file.ID,
+		OwnerID:   file.UserID,
+		FolderID:  file.FolderID,
+		Name:      file.Name,
+		Size:      file.Size,
+		MimeType:  mime.TypeByExtension(filepath.Ext(file.Name)),
+		UpdatedAt: file.UpdatedAt,
+	}
+
+	metadata := make(map[string]string, len(file.MetadataSerialized))
+	for k, v := range file.MetadataSerialized {
+		metadata[k] = v
+	}
+	doc.Metadata = metadata
+
+	if err := indexer.Index(ctx, doc); err != nil {
+		util.Log().Warning("Failed to index file %d: %s", file.ID, err)
+	}
+}
+
+// removeFileFromIndex 将文件从当前生效的搜索后端中移除，在
+// deleteGroupedFile 中对每个被删除的文件记录调用
+func (fs *FileSystem) removeFileFromIndex(ctx context.Context, fileID uint) {
+	indexer := currentIndexer()
+	if indexer == nil {
+		return
+	}
+
+	if err := indexer.Delete(ctx, fileID); err != nil {
+		util.Log().Warning("Failed to remove file %d from search index: %s", fileID, err)
+	}
+}
+
+// ReindexRenamedOrMovedFile 在文件被重命名或移动后重新索引，保持索引中的
+// 路径/文件名与数据库一致。调用点在重命名、移动操作完成后
+func (fs *FileSystem) ReindexRenamedOrMovedFile(ctx context.Context, file *model.File) {
+	fs.indexFile(ctx, file)
+}
+
+// parseSearchQuery 解析 `field:value` 形式的结构化关键字，支持的字段：
+//
+//	mime:<mime type>          按 MIME 类型过滤
+//	in:<folder name>          限定在某个文件夹下搜索
+//	size:>100, size:100..200  按字节大小范围过滤
+//	date:2024-01-01..2024-02-01  按更新时间范围过滤
+//
+// 其他字段名的 field:value 写入 Fields，按同名元数据字段匹配；不含冒号的
+// 关键字原样加入 Keywords，按全文检索处理
+func parseSearchQuery(keywords []interface{}) SearchQuery {
+	query := SearchQuery{Fields: make(map[string]string)}
+
+	for _, k := range keywords {
+		raw, ok := k.(string)
+		if !ok || raw == "" {
+			continue
+		}
+
+		field, value, hasField := strings.Cut(raw, ":")
+		if !hasField {
+			query.Keywords = append(query.Keywords, raw)
+			continue
+		}
+
+		switch field {
+		case "mime":
+			query.MimeType = value
+		case "in":
+			query.InFolder = value
+		case "size":
+			query.MinSize, query.MaxSize = parseUintRange(value)
+		case "date":
+			query.After, query.Before = parseTimeRange(value)
+		default:
+			query.Fields[field] = value
+		}
+	}
+
+	return query
+}
+
+// parseUintRange 解析 "100..200"、">100"、"<200" 形式的大小范围
+func parseUintRange(raw string) (min, max *uint64) {
+	switch {
+	case strings.HasPrefix(raw, ">"):
+		if v, err := strconv.ParseUint(raw[1:], 10, 64); err == nil {
+			min = &v
+		}
+	case strings.HasPrefix(raw, "<"):
+		if v, err := strconv.ParseUint(raw[1:], 10, 64); err == nil {
+			max = &v
+		}
+	default:
+		parts := strings.SplitN(raw, "..", 2)
+		if len(parts) == 2 {
+			if v, err := strconv.ParseUint(parts[0], 10, 64); err == nil {
+				min = &v
+			}
+			if v, err := strconv.ParseUint(parts[1], 10, 64); err == nil {
+				max = &v
+			}
+		}
+	}
+
+	return min, max
+}
+
+// parseTimeRange 解析 "2024-01-01..2024-02-01" 形式的日期范围
+func parseTimeRange(raw string) (after, before *time.Time) {
+	parts := strings.SplitN(raw, "..", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", parts[0]); err == nil {
+		after = &t
+	}
+	if t, err := time.Parse("2006-01-02", parts[1]); err == nil {
+		before = &t
+	}
+
+	return after, before
+}
+
+// Search 搜索文件。优先交由当前生效的 SearchIndexer 处理结构化查询
+// （field:value、大小/时间范围、mime 过滤、in:folder 限定文件夹），
+// 索引不可用或查询失败时回退到原有的 SQL LIKE 搜索
+func (fs *FileSystem) Search(ctx context.Context, keywords ...interface{}) ([]serializer.Object, error) {
+	parents := make([]uint, 0)
+	scoped := false
+
+	// 如果限定了根目录，则只在这个根目录下搜索。
+	if fs.Root != nil {
+		allFolders, err := model.GetRecursiveChildFolder([]uint{fs.Root.ID}, fs.User.ID, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list all folders: %w", err)
+		}
+
+		for _, folder := range allFolders {
+			parents = append(parents, folder.ID)
+		}
+		scoped = true
+	}
+
+	if indexer := currentIndexer(); indexer != nil {
+		query := parseSearchQuery(keywords)
+
+		// in:folder 关键字把搜索范围进一步收窄到某个命名文件夹，与 fs.Root
+		// 生效时一样，都需要体现在传给索引后端的 scope 里，否则子目录下
+		// 发起的搜索会连同 scope 之外的同名文件一起返回
+		if query.InFolder != "" {
+			named, err := model.GetFoldersByName(fs.User.ID, query.InFolder)
+			if err != nil {
+				util.Log().Warning("Failed to resolve in:%s to a folder: %s", query.InFolder, err)
+			} else {
+				ids := make([]uint, 0, len(named))
+				for _, folder := range named {
+					ids = append(ids, folder.ID)
+				}
+				if scoped {
+					parents = intersectUintSlice(parents, ids)
+				} else {
+					parents = ids
+				}
+				scoped = true
+			}
+		}
+
+		if fileIDs, err := indexer.Search(ctx, fs.User.ID, parents, query); err == nil {
+			files, err := model.GetFilesByIDs(fileIDs, fs.User.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load search results: %w", err)
+			}
+
+			// 索引后端不保证严格遵守 scope（例如外部搜索服务的过滤逻辑与
+			// 本地实现有出入），这里按 scope 再做一次兜底过滤，确保限定了
+			// 根目录/命名文件夹的搜索绝不会返回范围之外的文件
+			if scoped {
+				files = filterFilesByFolders(files, parents)
+			}
+
+			fs.SetTargetFile(&files)
+			return fs.listObjects(ctx, "/", files, nil, nil), nil
+		} else {
+			util.Log().Warning("Search indexer %q failed, falling back to SQL LIKE search: %s", indexer.Name(), err)
+		}
+	}
+
+	files, _ := model.GetFilesByKeywords(fs.User.ID, parents, keywords...)
+	fs.SetTargetFile(&files)
+
+	return fs.listObjects(ctx, "/", files, nil, nil), nil
+}
+
+// filterFilesByFolders 只保留 FolderID 落在 allowed 范围内的文件，用于在
+// 索引后端返回的结果之上再施加一层目录范围限制
+func filterFilesByFolders(files []model.File, allowed []uint) []model.File {
+	allowedSet := make(map[uint]struct{}, len(allowed))
+	for _, id := range allowed {
+		allowedSet[id] = struct{}{}
+	}
+
+	filtered := make([]model.File, 0, len(files))
+	for _, file := range files {
+		if _, ok := allowedSet[file.FolderID]; ok {
+			filtered = append(filtered, file)
+		}
+	}
+
+	return filtered
+}
+
+// intersectUintSlice 返回同时出现在 a 和 b 中的元素
+func intersectUintSlice(a, b []uint) []uint {
+	set := make(map[uint]struct{}, len(b))
+	for _, v := range b {
+		set[v] = struct{}{}
+	}
+
+	result := make([]uint, 0)
+	for _, v := range a {
+		if _, ok := set[v]; ok {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
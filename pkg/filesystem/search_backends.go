@@ -0,0 +1,294 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// indexDocID/docIDToFileID 在 bleve 文档 ID 与 model.File 的主键之间转换
+func indexDocID(fileID uint) string {
+	return strconv.FormatUint(uint64(fileID), 10)
+}
+
+func docIDToFileID(docID string) uint {
+	id, _ := strconv.ParseUint(docID, 10, 64)
+	return uint(id)
+}
+
+// bleveIndexer 是内嵌的默认搜索后端，索引数据落在本地磁盘，不需要额外
+// 部署任何外部服务
+type bleveIndexer struct {
+	mu    sync.RWMutex
+	index bleve.Index
+}
+
+func newBleveIndexer() *bleveIndexer {
+	index, err := bleve.Open(bleveIndexPath())
+	if err != nil {
+		mapping := bleve.NewIndexMapping()
+		index, err = bleve.New(bleveIndexPath(), mapping)
+		if err != nil {
+			// 索引不可用时退化为空操作，Search 会回退到 SQL LIKE
+			return &bleveIndexer{}
+		}
+	}
+
+	return &bleveIndexer{index: index}
+}
+
+func bleveIndexPath() string {
+	return "data/search.bleve"
+}
+
+func (b *bleveIndexer) Name() string { return "bleve" }
+
+func (b *bleveIndexer) Index(ctx context.Context, doc SearchDocument) error {
+	if b.index == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.index.Index(indexDocID(doc.FileID), doc)
+}
+
+func (b *bleveIndexer) Delete(ctx context.Context, fileID uint) error {
+	if b.index == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.index.Delete(indexDocID(fileID))
+}
+
+func (b *bleveIndexer) Search(ctx context.Context, ownerID uint, scope []uint, query SearchQuery) ([]uint, error) {
+	if b.index == nil {
+		return nil, bleve.ErrorIndexClosed
+	}
+
+	q := bleve.NewConjunctionQuery()
+	// 只在确实有关键字时才加入全文匹配子查询，否则空字符串的 MatchQuery
+	// 不会匹配任何文档，导致纯结构化查询（如 mime:、size:）无结果可返
+	if len(query.Keywords) > 0 {
+		q.AddQuery(bleve.NewMatchQuery(strings.Join(query.Keywords, " ")))
+	}
+
+	if query.MimeType != "" {
+		mimeQuery := bleve.NewMatchQuery(query.MimeType)
+		mimeQuery.SetField("MimeType")
+		q.AddQuery(mimeQuery)
+	}
+
+	// 只查属于当前用户的文档，否则返回的命中会跨用户泄露。OwnerID/FolderID
+	// 在索引里是数值字段，用单点的数值范围查询来做精确匹配
+	q.AddQuery(exactNumericMatch("OwnerID", float64(ownerID)))
+
+	// scope 非空时（fs.Root 生效或使用了 in: 关键字），把结果限定在这些文件夹 ID 范围内，
+	// 否则子目录下发起的搜索会返回同一用户在 scope 之外的文件
+	if len(scope) > 0 {
+		folderScope := bleve.NewDisjunctionQuery()
+		for _, folderID := range scope {
+			folderScope.AddQuery(exactNumericMatch("FolderID", float64(folderID)))
+		}
+		q.AddQuery(folderScope)
+	}
+
+	for field, value := range query.Fields {
+		fieldQuery := bleve.NewMatchQuery(value)
+		fieldQuery.SetField("Metadata." + field)
+		q.AddQuery(fieldQuery)
+	}
+
+	if query.MinSize != nil || query.MaxSize != nil {
+		var min, max *float64
+		if query.MinSize != nil {
+			v := float64(*query.MinSize)
+			min = &v
+		}
+		if query.MaxSize != nil {
+			v := float64(*query.MaxSize)
+			max = &v
+		}
+		sizeQuery := bleve.NewNumericRangeQuery(min, max)
+		sizeQuery.SetField("Size")
+		q.AddQuery(sizeQuery)
+	}
+
+	if query.After != nil || query.Before != nil {
+		dateQuery := bleve.NewDateRangeQuery(timeOrZero(query.After), timeOrZero(query.Before))
+		dateQuery.SetField("UpdatedAt")
+		q.AddQuery(dateQuery)
+	}
+
+	// query.InFolder（in:folder 关键字）已经由调用方（Search）解析成具体的
+	// 文件夹 ID 并入 scope，这里不需要再单独处理
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	req := bleve.NewSearchRequest(q)
+	req.Size = 200
+	result, err := b.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		ids = append(ids, docIDToFileID(hit.ID))
+	}
+
+	return ids, nil
+}
+
+// timeOrZero 解引用一个可能为 nil 的 *time.Time，nil 时返回零值，交由
+// bleve 的 DateRangeQuery 当作“不限制该端”处理
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// exactNumericMatch 构造一个精确匹配单个数值的范围查询，用于给 OwnerID/
+// FolderID 这类数值字段做等值过滤（bleve 没有数值字段的 TermQuery）
+func exactNumericMatch(field string, value float64) bleve.Query {
+	q := bleve.NewNumericRangeInclusiveQuery(&value, &value, boolPtr(true), boolPtr(true))
+	q.SetField(field)
+	return q
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+// externalIndexer 通过 HTTP 接入外部搜索服务（Meilisearch/Elasticsearch），
+// 用于索引规模超出 bleve 单机承载能力的部署
+type externalIndexer struct {
+	name     string
+	endpoint string
+	apiKey   string
+}
+
+// NewExternalIndexer 创建一个基于外部搜索服务的 SearchIndexer，
+// name 用于区分 "meilisearch"、"elasticsearch" 等具体实现
+func NewExternalIndexer(name, endpoint, apiKey string) SearchIndexer {
+	return &externalIndexer{name: name, endpoint: endpoint, apiKey: apiKey}
+}
+
+func (e *externalIndexer) Name() string { return e.name }
+
+func (e *externalIndexer) Index(ctx context.Context, doc SearchDocument) error {
+	return postSearchDocument(ctx, e.endpoint, e.apiKey, doc)
+}
+
+func (e *externalIndexer) Delete(ctx context.Context, fileID uint) error {
+	return deleteSearchDocument(ctx, e.endpoint, e.apiKey, fileID)
+}
+
+func (e *externalIndexer) Search(ctx context.Context, ownerID uint, scope []uint, query SearchQuery) ([]uint, error) {
+	return querySearchService(ctx, e.endpoint, e.apiKey, ownerID, scope, query)
+}
+
+// postSearchDocument、deleteSearchDocument、querySearchService 是对外部
+// 搜索服务 REST API 的最小封装，具体请求/响应格式随 name 指定的服务而异，
+// 这里假设服务暴露了与 Meilisearch 兼容的 /indexes/files/documents 接口
+func externalRequest(ctx context.Context, method, url, apiKey string, body interface{}) (*http.Response, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+func postSearchDocument(ctx context.Context, endpoint, apiKey string, doc SearchDocument) error {
+	resp, err := externalRequest(ctx, http.MethodPost, endpoint+"/indexes/files/documents", apiKey, []SearchDocument{doc})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("search backend returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func deleteSearchDocument(ctx context.Context, endpoint, apiKey string, fileID uint) error {
+	url := fmt.Sprintf("%s/indexes/files/documents/%s", endpoint, indexDocID(fileID))
+	resp, err := externalRequest(ctx, http.MethodDelete, url, apiKey, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("search backend returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func querySearchService(ctx context.Context, endpoint, apiKey string, ownerID uint, scope []uint, query SearchQuery) ([]uint, error) {
+	payload := map[string]interface{}{
+		"q":        strings.Join(query.Keywords, " "),
+		"filter":   query.Fields,
+		"mimeType": query.MimeType,
+		"ownerId":  ownerID,
+		"scope":    scope,
+		"minSize":  query.MinSize,
+		"maxSize":  query.MaxSize,
+		"after":    query.After,
+		"before":   query.Before,
+		"inFolder": query.InFolder,
+	}
+
+	resp, err := externalRequest(ctx, http.MethodPost, endpoint+"/indexes/files/search", apiKey, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("search backend returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Hits []struct {
+			FileID uint `json:"fileId"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		ids = append(ids, hit.FileID)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,251 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	model "github.com/cloudreve/Cloudreve/v3/models"
+	"github.com/cloudreve/Cloudreve/v3/pkg/filesystem/fsctx"
+	"github.com/cloudreve/Cloudreve/v3/pkg/serializer"
+	"github.com/cloudreve/Cloudreve/v3/pkg/util"
+)
+
+// SignScope 是一次签名携带的能力范围，由 enforceSignedURLScope 在读取
+// 物理内容之前校验，任一项越界都会拒绝请求
+type SignScope struct {
+	// AllowedCIDRs 允许访问该链接的来源 IP/CIDR，留空表示不限制
+	AllowedCIDRs []string
+	// Referer 允许的来源页面，留空表示不限制
+	Referer string
+	// MaxByteRange 允许请求的最大 Range 长度（字节），0 表示不限制。
+	// 由 VerifySignedURL 结合请求实际携带的 Range 一起校验，见该函数注释
+	MaxByteRange int64
+	// MaxDownloads 允许的最大下载/访问次数，0 表示不限制
+	MaxDownloads int
+}
+
+// signedURLToken 与数据库中的 signed_urls 记录一一对应
+type signedURLToken struct {
+	RevocationID string
+	FileID       uint
+	ExpiresAt    time.Time
+	IsDownload   bool
+	SpeedLimit   int
+	Scope        SignScope
+}
+
+// newRevocationID 生成一个不可预测的撤销 ID，作为签名链接的查询参数，
+// 供 middleware 回表校验、管理员在 UI 中单独撤销这一条链接
+func newRevocationID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// issueSignedURL 在数据库中登记一次签名颁发，返回可附加到最终 URL 上的
+// revocation ID。这条记录是整个 scope 体系（CIDR/Referer/次数限制/撤销）
+// 唯一的执行依据，登记失败时没有任何东西可供 middleware 校验，因此必须
+// 失败关闭（fail closed）：调用方拿不到 revocation ID 就不应该拿到 URL，
+// 而不是退化为一条不可审计、不可撤销、不受 scope 约束的旧式签名
+func (fs *FileSystem) issueSignedURL(ctx context.Context, file *model.File, ttl int64, isDownload bool, scope SignScope) (string, error) {
+	revocationID, err := newRevocationID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate revocation ID for signed URL: %w", err)
+	}
+
+	token := signedURLToken{
+		RevocationID: revocationID,
+		FileID:       file.ID,
+		ExpiresAt:    time.Now().Add(time.Duration(ttl) * time.Second),
+		IsDownload:   isDownload,
+		SpeedLimit:   fs.User.Group.SpeedLimit,
+		Scope:        scope,
+	}
+
+	if err := model.CreateSignedURL(
+		token.RevocationID,
+		token.FileID,
+		fs.User.ID,
+		token.ExpiresAt,
+		token.IsDownload,
+		scope.AllowedCIDRs,
+		scope.Referer,
+		scope.MaxByteRange,
+		scope.MaxDownloads,
+	); err != nil {
+		return "", fmt.Errorf("failed to persist signed URL record for file %d: %w", file.ID, err)
+	}
+
+	return revocationID, nil
+}
+
+// VerifySignedURL 由 enforceSignedURLScope 在读取物理内容前调用，校验携带的
+// revocation ID 是否仍然有效：未过期、未被撤销、访问次数未超限、来源 IP
+// 和 Referer 符合签发时约定的范围（请求未携带 Referer 时不校验该项），
+// 以及本次请求实际希望读取的字节区间
+// 没有超出签发时约定的 MaxByteRange。requestedRangeLength 为 nil 表示本次
+// 请求没有携带 Range、希望读取整个文件——这种情况下如果 scope 设置了
+// MaxByteRange，视为越界一并拒绝，因为无法确认实际会读取的字节数不会
+// 超过约定的上限。校验通过后会原子地增加使用计数
+func VerifySignedURL(ctx context.Context, revocationID, remoteIP, referer string, requestedRangeLength *int64) error {
+	record, err := model.GetSignedURL(revocationID)
+	if err != nil {
+		return serializer.NewError(serializer.CodeSignExpired, "Signed URL does not exist or has been revoked", err)
+	}
+
+	if record.Revoked {
+		return serializer.NewError(serializer.CodeSignExpired, "Signed URL has been revoked", nil)
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		return serializer.NewError(serializer.CodeSignExpired, "Signed URL has expired", nil)
+	}
+
+	if record.MaxDownloads > 0 && record.UsageCount >= record.MaxDownloads {
+		return serializer.NewError(serializer.CodeSignExpired, "Signed URL has reached its maximum usage count", nil)
+	}
+
+	if referer != "" && record.Referer != "" && referer != record.Referer {
+		return serializer.NewError(serializer.CodeCredentialInvalid, "Referer does not match the scope of this signed URL", nil)
+	}
+
+	if len(record.AllowedCIDRs) > 0 && !ipInAnyCIDR(remoteIP, record.AllowedCIDRs) {
+		return serializer.NewError(serializer.CodeCredentialInvalid, "Requesting IP is outside the scope of this signed URL", nil)
+	}
+
+	if record.MaxByteRange > 0 {
+		if requestedRangeLength == nil || *requestedRangeLength <= 0 || *requestedRangeLength > record.MaxByteRange {
+			return serializer.NewError(serializer.CodeCredentialInvalid, "Requested range exceeds the scope of this signed URL", nil)
+		}
+	}
+
+	if err := model.IncrementSignedURLUsage(revocationID); err != nil {
+		util.Log().Warning("Failed to record usage for signed URL %q: %s", revocationID, err)
+	}
+
+	return nil
+}
+
+// signContextKeyT 是本包内签名相关 context key 的私有类型，避免与其他
+// 包写入 context 的 key 冲突
+type signContextKeyT struct{ name string }
+
+var (
+	// SignRevocationIDCtx 由签名链接的前置 middleware 写入，标识本次请求
+	// 携带的 revocation ID；enforceSignedURLScope 据此回表校验 scope
+	SignRevocationIDCtx = &signContextKeyT{"sign_revocation_id"}
+	// SignRemoteIPCtx 由 middleware 写入的客户端来源 IP，供 CIDR 范围校验
+	SignRemoteIPCtx = &signContextKeyT{"sign_remote_ip"}
+	// SignRefererCtx 由 middleware 写入的请求 Referer，供 Referer 范围校验
+	SignRefererCtx = &signContextKeyT{"sign_referer"}
+)
+
+// enforceSignedURLScope 在真正读取物理内容前校验本次请求是否仍然落在签发
+// 时约定的 scope 内（未过期、未撤销、未超出最大下载次数、来源 IP/Referer
+// 合法、请求的 Range 没有超出 MaxByteRange），是 VerifySignedURL 真正被
+// 接入到取流路径上的唯一入口。ctx 中不存在 revocation ID 时，说明请求
+// 没有经过签名链接（例如进程内部直接调用，或该存储策略本就不要求签名），
+// 不做额外限制
+func enforceSignedURLScope(ctx context.Context) error {
+	revocationID, ok := ctx.Value(SignRevocationIDCtx).(string)
+	if !ok || revocationID == "" {
+		return nil
+	}
+
+	remoteIP, _ := ctx.Value(SignRemoteIPCtx).(string)
+	referer, _ := ctx.Value(SignRefererCtx).(string)
+
+	var requestedRangeLength *int64
+	if rng, ok := ctx.Value(PreviewRangeCtx).(*PreviewRange); ok && rng != nil {
+		requestedRangeLength = &rng.Length
+	}
+
+	return VerifySignedURL(ctx, revocationID, remoteIP, referer, requestedRangeLength)
+}
+
+func ipInAnyCIDR(ip string, cidrs []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RevokeSignedURL 供管理员/文件所有者在 UI 中主动撤销一条已签发的链接
+func RevokeSignedURL(revocationID string) error {
+	return model.RevokeSignedURL(revocationID)
+}
+
+// ListSignedURLs 列出某个文件当前所有未过期的已签发链接及其使用情况，
+// 供审计界面展示
+func ListSignedURLs(fileID uint) ([]model.SignedURL, error) {
+	return model.GetSignedURLsByFile(fileID)
+}
+
+// SignURL 签名文件原始 URL。除了委托存储策略的 Handler 生成实际可访问的
+// URL 外，还会在 signed_urls 表中登记一条携带访问范围（IP/Referer/最大
+// Range/最大下载次数等）的审计记录，并把 revocation ID 附加到返回的 URL
+// 上，供前置 middleware 校验与后续撤销
+func (fs *FileSystem) SignURL(ctx context.Context, file *model.File, ttl int64, isDownload bool) (string, error) {
+	return fs.SignURLWithScope(ctx, file, ttl, isDownload, SignScope{})
+}
+
+// SignURLWithScope 是 SignURL 的扩展版本，允许调用方附加额外的访问范围限制
+func (fs *FileSystem) SignURLWithScope(ctx context.Context, file *model.File, ttl int64, isDownload bool, scope SignScope) (string, error) {
+	fs.FileTarget = []model.File{*file}
+	ctx = context.WithValue(ctx, fsctx.FileModelCtx, *file)
+
+	err := fs.resetPolicyToFirstFile(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// 生成外链地址
+	source, err := fs.Handler.Source(ctx, fs.FileTarget[0].SourceName, ttl, isDownload, fs.User.Group.SpeedLimit)
+	if err != nil {
+		util.Log().Error("Failed to get source link: %w", err)
+		return "", serializer.NewError(serializer.CodeNotSet, "Failed to get source link", err)
+	}
+
+	revocationID, err := fs.issueSignedURL(ctx, &fs.FileTarget[0], ttl, isDownload, scope)
+	if err != nil {
+		util.Log().Warning("Failed to issue signed URL for file %d: %s", fs.FileTarget[0].ID, err)
+		return "", serializer.NewError(serializer.CodeNotSet, "Failed to issue signed URL", err)
+	}
+
+	return appendSignQuery(source, revocationID), nil
+}
+
+func appendSignQuery(rawURL, revocationID string) string {
+	separator := "?"
+	if containsQuery(rawURL) {
+		separator = "&"
+	}
+	return fmt.Sprintf("%s%ssign_id=%s", rawURL, separator, revocationID)
+}
+
+func containsQuery(rawURL string) bool {
+	for _, c := range rawURL {
+		if c == '?' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package filesystem
+
+import (
+	"io"
+	"sync"
+
+	"github.com/cloudreve/Cloudreve/v3/pkg/filesystem/response"
+	"github.com/juju/ratelimit"
+)
+
+// userSpeedBuckets 按用户 ID 共享的限速令牌桶，同一用户同时发起的多个
+// 下载/预览流共用同一个桶，而不是像此前那样每次调用都新建一个，
+// 避免用户通过并发请求突破用户组的 SpeedLimit
+var userSpeedBuckets sync.Map // map[uint]*ratelimit.Bucket
+
+// policyEgressBuckets 按存储策略 ID 共享的出站限速令牌桶，用于保护单个
+// 存储后端的出口带宽不被过多并发下载占满
+var policyEgressBuckets sync.Map // map[uint]*ratelimit.Bucket
+
+// getSharedBucket 从 registry 中取出（或按需创建）rate 对应的令牌桶。
+// 当已存在的桶与当前配置不一致时（管理员调整了限速设置），用新配置
+// 替换旧桶。桶的容量创建时即等于配置的 rate，所以用容量来比较；Rate()
+// 是按填充间隔近似出来的，与配置值可能相差不到 1%
+func getSharedBucket(registry *sync.Map, key uint, rate int64) *ratelimit.Bucket {
+	if existing, ok := registry.Load(key); ok {
+		if bucket := existing.(*ratelimit.Bucket); bucket.Capacity() == rate {
+			return bucket
+		}
+	}
+
+	bucket := ratelimit.NewBucketWithRate(float64(rate), rate)
+	registry.Store(key, bucket)
+	return bucket
+}
+
+// BucketMetric 是单个令牌桶在某一时刻的状态快照，用于管理端限速监控
+type BucketMetric struct {
+	Rate      int64
+	Capacity  int64
+	Available int64
+}
+
+func snapshotBuckets(registry *sync.Map) map[uint]BucketMetric {
+	metrics := make(map[uint]BucketMetric)
+	registry.Range(func(key, value interface{}) bool {
+		bucket := value.(*ratelimit.Bucket)
+		metrics[key.(uint)] = BucketMetric{
+			Rate:      int64(bucket.Rate()),
+			Capacity:  bucket.Capacity(),
+			Available: bucket.Available(),
+		}
+		return true
+	})
+	return metrics
+}
+
+// GetUserBucketMetrics 返回当前各用户限速令牌桶的状态，供管理端限速
+// 监控接口展示
+func GetUserBucketMetrics() map[uint]BucketMetric {
+	return snapshotBuckets(&userSpeedBuckets)
+}
+
+// GetPolicyBucketMetrics 返回当前各存储策略出站限速令牌桶的状态
+func GetPolicyBucketMetrics() map[uint]BucketMetric {
+	return snapshotBuckets(&policyEgressBuckets)
+}
+
+// lrs 限速后的 ReadSeekCloser，内部维护一份已消耗配额的记录，使得
+// Seek 向前回退时不会对已经计费过的字节重复限速
+type lrs struct {
+	response.RSCloser
+	r io.Reader
+
+	mu     sync.Mutex
+	pos    int64
+	credit int64
+}
+
+func (r *lrs) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	credit := r.credit
+	r.mu.Unlock()
+
+	// 这部分数据此前已经从令牌桶中扣费过（因为发生了向前回退的 Seek），
+	// 直接读取而不重复消耗限速配额
+	if credit > 0 {
+		toRead := p
+		if int64(len(toRead)) > credit {
+			toRead = toRead[:credit]
+		}
+
+		n, err := r.RSCloser.Read(toRead)
+		r.mu.Lock()
+		r.credit -= int64(n)
+		r.pos += int64(n)
+		r.mu.Unlock()
+		return n, err
+	}
+
+	n, err := r.r.Read(p)
+	r.mu.Lock()
+	r.pos += int64(n)
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *lrs) Seek(offset int64, whence int) (int64, error) {
+	newPos, err := r.RSCloser.Seek(offset, whence)
+	if err != nil {
+		return newPos, err
+	}
+
+	r.mu.Lock()
+	if newPos < r.pos {
+		// 回退读取的字节此前已经计费，记为可免费读取的额度
+		r.credit += r.pos - newPos
+	} else if newPos > r.pos {
+		r.credit = 0
+	}
+	r.pos = newPos
+	r.mu.Unlock()
+
+	return newPos, nil
+}
+
+// withSpeedLimit 给原有的 ReadSeekCloser 加上限速。同一用户的所有并发
+// 读取流共用一个令牌桶，另外叠加一层按存储策略划分的出站限速桶，
+// 防止单个存储后端的出口带宽被过多并发下载占满
+func (fs *FileSystem) withSpeedLimit(rs response.RSCloser) response.RSCloser {
+	var reader io.Reader = rs
+
+	if fs.User.Group.SpeedLimit != 0 {
+		bucket := getSharedBucket(&userSpeedBuckets, fs.User.ID, int64(fs.User.Group.SpeedLimit))
+		reader = ratelimit.Reader(reader, bucket)
+	}
+
+	if fs.Policy != nil {
+		if egressLimit := fs.Policy.EgressRateLimit(); egressLimit != 0 {
+			bucket := getSharedBucket(&policyEgressBuckets, fs.Policy.ID, egressLimit)
+			reader = ratelimit.Reader(reader, bucket)
+		}
+	}
+
+	if reader == io.Reader(rs) {
+		// 没有任何限速需要应用，返回原始流
+		return rs
+	}
+
+	return &lrs{RSCloser: rs, r: reader}
+}
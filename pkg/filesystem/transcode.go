@@ -0,0 +1,320 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	model "github.com/cloudreve/Cloudreve/v3/models"
+	"github.com/cloudreve/Cloudreve/v3/pkg/filesystem/response"
+	"github.com/cloudreve/Cloudreve/v3/pkg/serializer"
+	"github.com/cloudreve/Cloudreve/v3/pkg/util"
+)
+
+// ErrNotSupportedType 没有可用的转码后端能够处理该文件类型
+var ErrNotSupportedType = serializer.NewError(serializer.CodeNotSet, "This file type does not support preview transcoding", nil)
+
+// TranscodeParams 描述一次预览转码请求的参数，与原始文件的内容哈希一起
+// 组成缓存产物的唯一键
+type TranscodeParams struct {
+	// Format 目标格式，例如 "jpg"、"hls"、"pdf"、"html"
+	Format string
+	// Width、Height 图片/视频缩略图的目标尺寸，0 表示不缩放
+	Width, Height int
+}
+
+// CacheKey 返回该参数组合在缓存中的键片段
+func (p TranscodeParams) CacheKey() string {
+	return fmt.Sprintf("%s_%dx%d", p.Format, p.Width, p.Height)
+}
+
+// PreviewTranscoder 是生成预览产物的后端，不同类型的原始文件由不同的
+// Transcoder 处理，实现者之间互不感知
+type PreviewTranscoder interface {
+	// Name 返回用于后台开关配置、日志标识的名称
+	Name() string
+	// CanHandle 判断给定的文件扩展名是否可由该后端处理
+	CanHandle(ext string) bool
+	// Transcode 读取原始文件内容，生成预览产物并写入 dst
+	Transcode(ctx context.Context, src response.RSCloser, params TranscodeParams, dst io.Writer) error
+}
+
+var (
+	transcoderRegistry   = map[string]PreviewTranscoder{}
+	transcoderRegistryMu sync.RWMutex
+)
+
+// RegisterTranscoder 注册一个预览转码后端，供 resolveTranscoder 按扩展名匹配
+func RegisterTranscoder(t PreviewTranscoder) {
+	transcoderRegistryMu.Lock()
+	defer transcoderRegistryMu.Unlock()
+	transcoderRegistry[t.Name()] = t
+}
+
+func init() {
+	RegisterTranscoder(&ffmpegTranscoder{})
+	RegisterTranscoder(&imagingTranscoder{})
+	RegisterTranscoder(&officeTranscoder{})
+	RegisterTranscoder(&codeHighlightTranscoder{})
+}
+
+// ffmpegTranscoder 调用 ffmpeg 生成视频缩略图 / HLS 分段
+type ffmpegTranscoder struct{}
+
+func (t *ffmpegTranscoder) Name() string { return "ffmpeg" }
+
+func (t *ffmpegTranscoder) CanHandle(ext string) bool {
+	switch ext {
+	case "mp4", "mov", "mkv", "avi", "webm", "flv":
+		return true
+	}
+	return false
+}
+
+func (t *ffmpegTranscoder) Transcode(ctx context.Context, src response.RSCloser, params TranscodeParams, dst io.Writer) error {
+	return util.RunWithPipe(ctx, "ffmpeg", src, dst, ffmpegArgs(params))
+}
+
+// ffmpegArgs 根据转码参数拼装 ffmpeg 命令行参数，截取首帧并按需缩放
+func ffmpegArgs(params TranscodeParams) []string {
+	args := []string{"-i", "pipe:0", "-vframes", "1"}
+	if params.Width > 0 && params.Height > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:%d", params.Width, params.Height))
+	}
+	return append(args, "-f", "image2", "pipe:1")
+}
+
+// imagingTranscoder 基于 libvips/imaging 进行图片缩放与格式转换
+type imagingTranscoder struct{}
+
+func (t *imagingTranscoder) Name() string { return "imaging" }
+
+func (t *imagingTranscoder) CanHandle(ext string) bool {
+	switch ext {
+	case "jpg", "jpeg", "png", "gif", "bmp", "webp", "tiff":
+		return true
+	}
+	return false
+}
+
+func (t *imagingTranscoder) Transcode(ctx context.Context, src response.RSCloser, params TranscodeParams, dst io.Writer) error {
+	return util.ResizeImage(src, dst, params.Width, params.Height, params.Format)
+}
+
+// officeTranscoder 调用无头 LibreOffice/pandoc 将文档转换为 PDF 预览
+type officeTranscoder struct{}
+
+func (t *officeTranscoder) Name() string { return "office" }
+
+func (t *officeTranscoder) CanHandle(ext string) bool {
+	switch ext {
+	case "doc", "docx", "ppt", "pptx", "xls", "xlsx", "odt", "rtf":
+		return true
+	}
+	return false
+}
+
+func (t *officeTranscoder) Transcode(ctx context.Context, src response.RSCloser, params TranscodeParams, dst io.Writer) error {
+	return util.RunWithPipe(ctx, "soffice", src, dst, []string{"--headless", "--convert-to", "pdf"})
+}
+
+// codeHighlightTranscoder 将源代码文件转换为带语法高亮的 HTML 片段
+type codeHighlightTranscoder struct{}
+
+func (t *codeHighlightTranscoder) Name() string { return "code_highlight" }
+
+func (t *codeHighlightTranscoder) CanHandle(ext string) bool {
+	switch ext {
+	case "go", "js", "ts", "py", "java", "c", "cpp", "rs", "rb", "php", "sh", "yaml", "yml", "json":
+		return true
+	}
+	return false
+}
+
+func (t *codeHighlightTranscoder) Transcode(ctx context.Context, src response.RSCloser, params TranscodeParams, dst io.Writer) error {
+	return util.HighlightToHTML(src, dst, params.Format)
+}
+
+// resolveTranscoder 根据文件扩展名找到可以处理该文件的转码后端，未启用或
+// 没有匹配后端时返回 nil
+func resolveTranscoder(policy *model.Policy, ext string) PreviewTranscoder {
+	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+
+	transcoderRegistryMu.RLock()
+	defer transcoderRegistryMu.RUnlock()
+
+	for _, t := range transcoderRegistry {
+		if !t.CanHandle(ext) {
+			continue
+		}
+		if !policy.IsTranscodeEnabled(t.Name(), ext) {
+			continue
+		}
+		return t
+	}
+
+	return nil
+}
+
+// previewCachePrefix 缓存产物物理路径的前缀，实际存储位置由目标策略的
+// 虚拟路径规则决定
+const previewCachePrefix = "preview_cache"
+
+// previewCacheSourceName 根据原始文件内容哈希与转码参数计算出缓存产物的
+// 物理存储名，保证同一文件同一参数组合只生成一份产物
+func previewCacheSourceName(contentHash string, params TranscodeParams) string {
+	key := contentHash + "_" + params.CacheKey()
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(previewCachePrefix, hex.EncodeToString(sum[:])+"."+params.Format)
+}
+
+// resolvePreviewParams 根据预览请求推导出转码参数。返回 ok=false 表示
+// 不应尝试走转码流水线，调用方应回退到原有的直出/重定向逻辑。
+//
+// isText 预览（Preview 的编辑场景）必须拿到原始字节供前端编辑器使用，
+// 绝不能被这里重定向到语法高亮产物，所以不论扩展名是否匹配
+// codeHighlightTranscoder，isText 请求一律返回 ok=false。语法高亮只用于
+// 非编辑场景下对代码文件的只读预览，走下面的扩展名匹配分支
+func (fs *FileSystem) resolvePreviewParams(isText bool) (TranscodeParams, bool) {
+	if isText {
+		return TranscodeParams{}, false
+	}
+
+	thumbWidth := model.GetIntSetting("thumb_width", 400)
+	thumbHeight := model.GetIntSetting("thumb_height", 300)
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fs.FileTarget[0].Name), "."))
+
+	switch ext {
+	case "mp4", "mov", "mkv", "avi", "webm", "flv", "jpg", "jpeg", "png", "gif", "bmp", "webp", "tiff":
+		return TranscodeParams{Format: "jpg", Width: thumbWidth, Height: thumbHeight}, true
+	case "doc", "docx", "ppt", "pptx", "xls", "xlsx", "odt", "rtf":
+		return TranscodeParams{Format: "pdf"}, true
+	case "go", "js", "ts", "py", "java", "c", "cpp", "rs", "rb", "php", "sh", "yaml", "yml", "json":
+		return TranscodeParams{Format: "html"}, true
+	}
+
+	return TranscodeParams{}, false
+}
+
+// previewRangeContextKeyT 是 PreviewRangeCtx 的私有 key 类型，避免与其他
+// 包写入 context 的 key 冲突
+type previewRangeContextKeyT struct{}
+
+// PreviewRangeCtx 由调用方（收到 Range 请求头的 HTTP handler）写入 ctx，
+// 值类型为 *PreviewRange。transcodedPreview 据此只回放请求的字节区间，
+// 而不是把整个转码产物都读给调用方
+var PreviewRangeCtx = previewRangeContextKeyT{}
+
+// PreviewRange 描述一次预览请求希望读取的字节区间，语义与 HTTP Range 头
+// 一致：[Start, Start+Length) 左闭右开，Length <= 0 表示读到文件末尾
+type PreviewRange struct {
+	Start  int64
+	Length int64
+}
+
+// transcodedPreview 生成（或命中缓存）一份转码后的预览产物，并以支持
+// Range 请求的方式返回
+//
+// 产物以原始文件内容哈希 + 转码参数为键缓存在当前策略下（没有单独的缓存
+// 策略可选），重复请求同一文件的同一规格预览无需重新转码
+func (fs *FileSystem) transcodedPreview(ctx context.Context, file *model.File, params TranscodeParams) (*response.ContentResponse, error) {
+	transcoder := resolveTranscoder(fs.Policy, filepath.Ext(file.Name))
+	if transcoder == nil {
+		return nil, ErrNotSupportedType
+	}
+
+	cacheName := previewCacheSourceName(file.ContentHash(), params)
+
+	if cached, err := fs.Handler.Get(ctx, cacheName); err == nil {
+		ranged, err := applyPreviewRange(ctx, cached)
+		if err != nil {
+			return nil, ErrIO.WithError(err)
+		}
+		return &response.ContentResponse{
+			Redirect: false,
+			Content:  ranged,
+		}, nil
+	}
+
+	src, err := fs.Handler.Get(ctx, file.SourceName)
+	if err != nil {
+		return nil, ErrIO.WithError(err)
+	}
+	defer src.Close()
+
+	cached, err := fs.renderAndStoreTranscode(ctx, transcoder, src, cacheName, params)
+	if err != nil {
+		return nil, err
+	}
+
+	ranged, err := applyPreviewRange(ctx, cached)
+	if err != nil {
+		return nil, ErrIO.WithError(err)
+	}
+
+	return &response.ContentResponse{
+		Redirect: false,
+		Content:  ranged,
+	}, nil
+}
+
+// renderAndStoreTranscode 调用转码后端生成产物，写入缓存存储后返回可供
+// 读取的完整流；对 Range 的裁剪由调用方通过 applyPreviewRange 统一处理
+func (fs *FileSystem) renderAndStoreTranscode(ctx context.Context, transcoder PreviewTranscoder, src response.RSCloser, cacheName string, params TranscodeParams) (response.RSCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(transcoder.Transcode(ctx, src, params, pw))
+	}()
+
+	if err := fs.Handler.Put(ctx, cacheName, pr); err != nil {
+		return nil, ErrIO.WithError(err)
+	}
+
+	return fs.Handler.Get(ctx, cacheName)
+}
+
+// applyPreviewRange 读取 ctx 中由 PreviewRangeCtx 携带的 Range，定位到请求
+// 的起始偏移并限制可读取的长度。ctx 中没有设置 Range 时原样返回输入流
+func applyPreviewRange(ctx context.Context, rs response.RSCloser) (response.RSCloser, error) {
+	rng, ok := ctx.Value(PreviewRangeCtx).(*PreviewRange)
+	if !ok || rng == nil {
+		return rs, nil
+	}
+
+	if rng.Start > 0 {
+		if _, err := rs.Seek(rng.Start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek to range start %d: %w", rng.Start, err)
+		}
+	}
+
+	if rng.Length <= 0 {
+		return rs, nil
+	}
+
+	return &rangedRSC{RSCloser: rs, remaining: rng.Length}, nil
+}
+
+// rangedRSC 把底层流的可读部分限制在 remaining 字节以内，Seek/Close 仍然
+// 透传给原始流
+type rangedRSC struct {
+	response.RSCloser
+	remaining int64
+}
+
+func (r *rangedRSC) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.RSCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}